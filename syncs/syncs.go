@@ -5,9 +5,20 @@
 package syncs
 
 import (
+	"bytes"
+	"container/list"
 	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"log"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"tailscale.com/util/mak"
 )
@@ -111,29 +122,148 @@ func (wg *WaitGroupChan) Decr() {
 }
 
 // Wait blocks until the WaitGroupChan counter is zero.
-func (wg *WaitGroupChan) Wait() { <-wg.done }
+func (wg *WaitGroupChan) Wait() {
+	h := debugAcquire("WaitGroupChan.Wait")
+	defer debugRelease(h)
+	<-wg.done
+}
+
+// Group mirrors the essential API of x/sync/errgroup.Group: it runs a set of
+// goroutines and collects their first error, cancelling a derived context
+// when that error occurs.
+//
+// Unlike sync.WaitGroup, a Group's zero value is not usable; use WithContext
+// to create one.
+type Group struct {
+	cancel context.CancelFunc
+
+	wg      *WaitGroupChan
+	errOnce sync.Once
+	err     error
+
+	sem Semaphore // zero value disables limiting until SetLimit is called
+}
+
+// WithContext returns a new Group and an associated Context derived from ctx.
+//
+// The derived Context is canceled the first time a function passed to Go
+// returns a non-nil error or the first time Wait returns, whichever occurs
+// first.
+func WithContext(ctx context.Context) (*Group, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	g := &Group{cancel: cancel, wg: NewWaitGroupChan()}
+	g.wg.Add(1) // reference held until Wait is called; see Wait
+	return g, ctx
+}
+
+// Wait blocks until all function calls from the Go method have returned,
+// then returns the first non-nil error (if any) from them.
+func (g *Group) Wait() error {
+	g.wg.Decr() // release the reference taken in WithContext
+	g.wg.Wait()
+	if g.cancel != nil {
+		g.cancel()
+	}
+	return g.err
+}
+
+// Go calls the given function in a new goroutine.
+//
+// The first call to return a non-nil error cancels the Group's context, if
+// it was created by WithContext. The error will be returned by Wait.
+//
+// If SetLimit has been called with a positive value, Go blocks until fewer
+// than the limit goroutines are in flight.
+func (g *Group) Go(f func() error) {
+	if g.sem.c != nil {
+		g.sem.Acquire()
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Decr()
+		if g.sem.c != nil {
+			defer g.sem.Release()
+		}
+		if err := f(); err != nil {
+			g.errOnce.Do(func() {
+				g.err = err
+				if g.cancel != nil {
+					g.cancel()
+				}
+			})
+		}
+	}()
+}
+
+// TryGo calls the given function in a new goroutine only if the Group's
+// limit, set by SetLimit, has not yet been reached. It reports whether the
+// goroutine was started.
+func (g *Group) TryGo(f func() error) bool {
+	if g.sem.c != nil && !g.sem.TryAcquire() {
+		return false
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Decr()
+		if g.sem.c != nil {
+			defer g.sem.Release()
+		}
+		if err := f(); err != nil {
+			g.errOnce.Do(func() {
+				g.err = err
+				if g.cancel != nil {
+					g.cancel()
+				}
+			})
+		}
+	}()
+	return true
+}
+
+// SetLimit limits the number of active goroutines in this group to at most
+// n. A negative value indicates no limit.
+//
+// SetLimit must not be called concurrently with Go or TryGo, and should
+// typically be called before the first call to either.
+func (g *Group) SetLimit(n int) {
+	if n < 0 {
+		g.sem = Semaphore{}
+		return
+	}
+	g.sem = NewSemaphore(n)
+}
 
 // Semaphore is a counting semaphore.
 //
 // Use NewSemaphore to create one.
 type Semaphore struct {
 	c chan struct{}
+
+	// dbg carries the debugHold (if any) for each currently acquired slot
+	// in c, so that Release can retire one. Release retires the oldest
+	// recorded hold, which is not necessarily the one recorded by the
+	// goroutine that is releasing. It is only populated when
+	// debug mode is enabled (see SetDebug); it is always allocated so
+	// that enabling debug mode after construction still works.
+	dbg chan *debugHold
 }
 
 // NewSemaphore returns a semaphore with resource count n.
 func NewSemaphore(n int) Semaphore {
-	return Semaphore{c: make(chan struct{}, n)}
+	return Semaphore{c: make(chan struct{}, n), dbg: make(chan *debugHold, n)}
 }
 
 // Acquire blocks until a resource is acquired.
 func (s Semaphore) Acquire() {
 	s.c <- struct{}{}
+	s.debugAcquired()
 }
 
 // AcquireContext reports whether the resource was acquired before the ctx was done.
 func (s Semaphore) AcquireContext(ctx context.Context) bool {
 	select {
 	case s.c <- struct{}{}:
+		s.debugAcquired()
 		return true
 	case <-ctx.Done():
 		return false
@@ -144,6 +274,7 @@ func (s Semaphore) AcquireContext(ctx context.Context) bool {
 func (s Semaphore) TryAcquire() bool {
 	select {
 	case s.c <- struct{}{}:
+		s.debugAcquired()
 		return true
 	default:
 		return false
@@ -153,6 +284,148 @@ func (s Semaphore) TryAcquire() bool {
 // Release releases a resource.
 func (s Semaphore) Release() {
 	<-s.c
+	select {
+	case h := <-s.dbg:
+		debugRelease(h)
+	default:
+	}
+}
+
+// debugAcquired records, when debug mode is enabled, that this goroutine
+// just acquired a slot, so that Dump and the watchdog can report it.
+func (s Semaphore) debugAcquired() {
+	h := debugAcquire("Semaphore")
+	if h == nil {
+		return
+	}
+	select {
+	case s.dbg <- h:
+	default:
+		// dbg has the same capacity as c and we only push after sending
+		// on c, but Release frees its slot in c before taking a hold off
+		// dbg, so dbg can briefly be full here. Drop the hold rather than
+		// block.
+		debugRelease(h)
+	}
+}
+
+// WeightedSemaphore is a weighted semaphore that allows callers to acquire
+// more than one unit of its capacity at a time.
+//
+// Unlike [Semaphore], waiters are served in FIFO order: when Release frees up
+// capacity, the waiter queue is walked from the head and each waiter whose
+// request now fits is woken, stopping at the first one that doesn't, so a
+// large request doesn't starve behind a stream of smaller ones.
+//
+// Use NewWeightedSemaphore to create one.
+type WeightedSemaphore struct {
+	size    int64
+	mu      sync.Mutex
+	cur     int64
+	waiters list.List // of *weightedWaiter
+}
+
+type weightedWaiter struct {
+	n     int64
+	ready chan struct{} // closed when the waiter is granted its n units
+}
+
+// NewWeightedSemaphore returns a weighted semaphore with the given maximum
+// combined weight of acquired units.
+func NewWeightedSemaphore(n int64) *WeightedSemaphore {
+	return &WeightedSemaphore{size: n}
+}
+
+// Acquire blocks until n units are available and acquires them, or until ctx
+// is done, in which case it returns ctx.Err() and acquires nothing.
+//
+// If ctx is already done, Acquire may still succeed without blocking if n
+// units are immediately available.
+func (s *WeightedSemaphore) Acquire(ctx context.Context, n int64) error {
+	s.mu.Lock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		s.mu.Unlock()
+		return nil
+	}
+
+	if n > s.size {
+		s.mu.Unlock()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	w := &weightedWaiter{n: n, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		err := ctx.Err()
+		s.mu.Lock()
+		select {
+		case <-w.ready:
+			// Acquired the semaphore after cancellation; pretend we didn't
+			// notice the cancellation and report success: the caller now
+			// holds the n units.
+			err = nil
+		default:
+			isFront := s.waiters.Front() == elem
+			s.waiters.Remove(elem)
+			// If we were at the front and there's extra capacity left,
+			// notify other waiters that might now fit.
+			if isFront && s.size > s.cur {
+				s.notifyWaiters()
+			}
+		}
+		s.mu.Unlock()
+		return err
+	case <-w.ready:
+		return nil
+	}
+}
+
+// TryAcquire reports, without blocking, whether n units were acquired.
+func (s *WeightedSemaphore) TryAcquire(n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		return true
+	}
+	return false
+}
+
+// Release releases n units from the semaphore.
+func (s *WeightedSemaphore) Release(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cur -= n
+	if s.cur < 0 {
+		panic("syncs: released more than held")
+	}
+	s.notifyWaiters()
+}
+
+// notifyWaiters wakes waiters from the front of the queue while there's
+// enough remaining capacity for them, stopping at the first waiter that
+// doesn't fit so that FIFO order is preserved.
+//
+// s.mu must be held.
+func (s *WeightedSemaphore) notifyWaiters() {
+	for {
+		elem := s.waiters.Front()
+		if elem == nil {
+			break
+		}
+		w := elem.Value.(*weightedWaiter)
+		if s.size-s.cur < w.n {
+			break
+		}
+		s.cur += w.n
+		s.waiters.Remove(elem)
+		close(w.ready)
+	}
 }
 
 // Map is a Go map protected by a [sync.RWMutex].
@@ -160,8 +433,22 @@ func (s Semaphore) Release() {
 // at a relatively high frequency.
 // This must not be shallow copied.
 type Map[K comparable, V any] struct {
-	mu sync.RWMutex
-	m  map[K]V
+	mu  sync.RWMutex
+	m   map[K]V
+	dbg atomic.Pointer[debugHold] // current write-lock holder, when debug mode is tracking it
+}
+
+// lock is like m.mu.Lock, but also records, when debug mode is enabled,
+// where the write lock was acquired, so that Dump and the watchdog can
+// report on a Map whose writer is stuck.
+func (m *Map[K, V]) lock() {
+	m.mu.Lock()
+	m.dbg.Store(debugAcquire("Map"))
+}
+
+func (m *Map[K, V]) unlock() {
+	debugRelease(m.dbg.Swap(nil))
+	m.mu.Unlock()
 }
 
 func (m *Map[K, V]) Load(key K) (value V, ok bool) {
@@ -172,8 +459,8 @@ func (m *Map[K, V]) Load(key K) (value V, ok bool) {
 }
 
 func (m *Map[K, V]) Store(key K, value V) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.lock()
+	defer m.unlock()
 	mak.Set(&m.m, key, value)
 }
 
@@ -182,8 +469,8 @@ func (m *Map[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
 		return actual, loaded
 	}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.lock()
+	defer m.unlock()
 	actual, loaded = m.m[key]
 	if !loaded {
 		actual = value
@@ -193,8 +480,8 @@ func (m *Map[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
 }
 
 func (m *Map[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.lock()
+	defer m.unlock()
 	value, loaded = m.m[key]
 	if loaded {
 		delete(m.m, key)
@@ -203,8 +490,8 @@ func (m *Map[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
 }
 
 func (m *Map[K, V]) Delete(key K) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.lock()
+	defer m.unlock()
 	delete(m.m, key)
 }
 
@@ -217,3 +504,471 @@ func (m *Map[K, V]) Range(f func(key K, value V) bool) {
 		}
 	}
 }
+
+// Result holds the result of a Singleflight call, for use with DoChan.
+type Result[V any] struct {
+	Val    V
+	Err    error
+	Shared bool
+}
+
+// Singleflight provides a mechanism for deduplicating concurrent calls for
+// the same key, so that only one of them is actually executed. It mirrors
+// the well-known pattern from x/sync/singleflight, generalized with type
+// parameters.
+//
+// The zero value is ready to use.
+type Singleflight[K comparable, V any] struct {
+	calls Map[K, *sfCall[V]]
+}
+
+type sfCall[V any] struct {
+	wg       sync.WaitGroup
+	val      V
+	err      error
+	panicVal any          // non-nil if fn panicked; re-raised in every waiter
+	dups     atomic.Int32 // number of callers beyond the first that joined this call
+}
+
+// Do executes and returns the results of the given function, making sure
+// that only one execution is in-flight for a given key at a time. If a
+// duplicate call comes in, that caller waits for the original to complete
+// and receives the same results. The third return value reports whether v
+// was shared with another caller: it's true both for a duplicate caller
+// that waited for an in-flight call, and for the original caller of a call
+// that turned out to have duplicates join it.
+//
+// If fn panics, Do still removes the entry for key (so a later call starts
+// a fresh fn rather than reusing a poisoned one) and re-panics the same
+// value in the original goroutine and in every goroutine that was waiting
+// on it, matching x/sync/singleflight.
+func (g *Singleflight[K, V]) Do(key K, fn func() (V, error)) (v V, err error, shared bool) {
+	c := new(sfCall[V])
+	c.wg.Add(1)
+	actual, loaded := g.calls.LoadOrStore(key, c)
+	if loaded {
+		actual.dups.Add(1)
+		actual.wg.Wait()
+		if actual.panicVal != nil {
+			panic(actual.panicVal)
+		}
+		return actual.val, actual.err, true
+	}
+
+	normalReturn := false
+	defer func() {
+		if !normalReturn {
+			if r := recover(); r != nil {
+				c.panicVal = r
+			}
+		}
+		g.calls.Delete(key)
+		c.wg.Done()
+		if c.panicVal != nil {
+			panic(c.panicVal)
+		}
+	}()
+	c.val, c.err = fn()
+	normalReturn = true
+	return c.val, c.err, c.dups.Load() > 0
+}
+
+// DoChan is like Do but returns a channel that will receive the result when
+// it's ready. The channel is never closed and receives exactly one value.
+func (g *Singleflight[K, V]) DoChan(key K, fn func() (V, error)) <-chan Result[V] {
+	ch := make(chan Result[V], 1)
+	go func() {
+		v, err, shared := g.Do(key, fn)
+		ch <- Result[V]{Val: v, Err: err, Shared: shared}
+	}()
+	return ch
+}
+
+// Forget tells the Singleflight to forget about a key. Future calls to Do
+// for this key will call fn rather than waiting for an earlier call to
+// complete.
+func (g *Singleflight[K, V]) Forget(key K) {
+	g.calls.Delete(key)
+}
+
+// ShardedMap is a Go map protected by N [sync.RWMutex]-guarded shards,
+// for high-contention workloads where a single [Map] becomes a bottleneck
+// (for example, peer key to endpoint lookups in magicsock).
+//
+// Range provides a per-shard snapshot-free iteration and does not hold all
+// shard locks at once, so it is safe to call concurrently with mutations on
+// other shards, but it may observe some keys as they existed before and
+// others as they existed after a concurrent mutation.
+//
+// Use NewShardedMap to create one.
+type ShardedMap[K comparable, V any] struct {
+	hash   func(K) uint64
+	shards []*shardedMapShard[K, V]
+}
+
+type shardedMapShard[K comparable, V any] struct {
+	mu sync.RWMutex
+	m  map[K]V
+}
+
+// ShardedMapOption configures a ShardedMap constructed with NewShardedMap.
+type ShardedMapOption[K comparable] func(*shardedMapOpts[K])
+
+type shardedMapOpts[K comparable] struct {
+	shards int
+	hash   func(K) uint64
+}
+
+// NumShards sets the number of shards to use. It panics if n is not
+// positive. If unspecified, NewShardedMap uses runtime.GOMAXPROCS(0), or 16
+// if that isn't positive.
+func NumShards[K comparable](n int) ShardedMapOption[K] {
+	if n <= 0 {
+		panic("syncs: NumShards requires a positive shard count")
+	}
+	return func(o *shardedMapOpts[K]) { o.shards = n }
+}
+
+// WithHasher sets the function used to assign keys to shards. If
+// unspecified, NewShardedMap hashes keys with a [maphash.Hash] seeded once
+// per ShardedMap, writing common key types (strings, byte slices, and
+// fixed-size integers) directly into the hash; other key types fall back
+// to reflection-based formatting, which is much slower. Provide a custom
+// hasher for those, or for key types whose default formatting doesn't
+// uniquely identify the value.
+func WithHasher[K comparable](hash func(K) uint64) ShardedMapOption[K] {
+	return func(o *shardedMapOpts[K]) { o.hash = hash }
+}
+
+// NewShardedMap returns a new ShardedMap configured by opts.
+func NewShardedMap[K comparable, V any](opts ...ShardedMapOption[K]) *ShardedMap[K, V] {
+	var o shardedMapOpts[K]
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.shards <= 0 {
+		o.shards = runtime.GOMAXPROCS(0)
+		if o.shards <= 0 {
+			o.shards = 16
+		}
+	}
+	if o.hash == nil {
+		o.hash = defaultShardHasher[K](maphash.MakeSeed())
+	}
+	shards := make([]*shardedMapShard[K, V], o.shards)
+	for i := range shards {
+		shards[i] = new(shardedMapShard[K, V])
+	}
+	return &ShardedMap[K, V]{hash: o.hash, shards: shards}
+}
+
+func (m *ShardedMap[K, V]) shardFor(key K) *shardedMapShard[K, V] {
+	return m.shards[m.hash(key)%uint64(len(m.shards))]
+}
+
+// defaultShardHasher returns the default hash function used by
+// NewShardedMap: it writes common key types directly into a [maphash.Hash]
+// without allocating, and falls back to reflection-based formatting (via
+// fmt.Fprint) for everything else.
+func defaultShardHasher[K comparable](seed maphash.Seed) func(K) uint64 {
+	return func(k K) uint64 {
+		var h maphash.Hash
+		h.SetSeed(seed)
+		switch v := any(k).(type) {
+		case string:
+			h.WriteString(v)
+		case []byte:
+			h.Write(v)
+		case int:
+			writeUint64(&h, uint64(v))
+		case int8:
+			h.WriteByte(byte(v))
+		case int16:
+			writeUint64(&h, uint64(uint16(v)))
+		case int32:
+			writeUint64(&h, uint64(uint32(v)))
+		case int64:
+			writeUint64(&h, uint64(v))
+		case uint:
+			writeUint64(&h, uint64(v))
+		case uint8:
+			h.WriteByte(v)
+		case uint16:
+			writeUint64(&h, uint64(v))
+		case uint32:
+			writeUint64(&h, uint64(v))
+		case uint64:
+			writeUint64(&h, v)
+		case uintptr:
+			writeUint64(&h, uint64(v))
+		default:
+			fmt.Fprint(&h, v)
+		}
+		return h.Sum64()
+	}
+}
+
+func writeUint64(h *maphash.Hash, v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	h.Write(buf[:])
+}
+
+func (m *ShardedMap[K, V]) Load(key K) (value V, ok bool) {
+	s := m.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok = s.m[key]
+	return value, ok
+}
+
+func (m *ShardedMap[K, V]) Store(key K, value V) {
+	s := m.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mak.Set(&s.m, key, value)
+}
+
+func (m *ShardedMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	s := m.shardFor(key)
+	s.mu.RLock()
+	actual, loaded = s.m[key]
+	s.mu.RUnlock()
+	if loaded {
+		return actual, loaded
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	actual, loaded = s.m[key]
+	if !loaded {
+		actual = value
+		mak.Set(&s.m, key, value)
+	}
+	return actual, loaded
+}
+
+func (m *ShardedMap[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
+	s := m.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, loaded = s.m[key]
+	if loaded {
+		delete(s.m, key)
+	}
+	return value, loaded
+}
+
+func (m *ShardedMap[K, V]) Delete(key K) {
+	s := m.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, key)
+}
+
+// Range calls f sequentially for each key and value present in the map,
+// one shard at a time. If f returns false, Range stops the iteration.
+//
+// Range does not hold all shard locks at once: it locks one shard, iterates
+// over it, then moves to the next, so it is safe to call concurrently with
+// mutations on other shards. It does not provide a consistent snapshot of
+// the whole map.
+func (m *ShardedMap[K, V]) Range(f func(key K, value V) bool) {
+	for _, s := range m.shards {
+		if !s.rangeShard(f) {
+			return
+		}
+	}
+}
+
+// rangeShard ranges over a single shard, reporting whether the caller's
+// func returned true for every entry (and thus whether Range should
+// continue to the next shard).
+func (s *shardedMapShard[K, V]) rangeShard(f func(key K, value V) bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k, v := range s.m {
+		if !f(k, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Debugging support for diagnosing deadlocks and contention in syncs
+// primitives: DebugMutex, SetDebug, and Dump below. This is intended to
+// help debug the intermittent "tailscaled stuck" class of bug report,
+// where some background goroutine is blocked forever on a Semaphore or
+// WaitGroupChan.
+
+var debugEnabled atomic.Bool
+
+// SetDebug enables or disables debug instrumentation for syncs
+// primitives. When enabled, [Map], [Semaphore], and [WaitGroupChan] record
+// a stack trace for each goroutine currently holding a Semaphore slot or a
+// Map write lock, or blocked in WaitGroupChan.Wait, which can be inspected
+// with Dump; a watchdog goroutine also periodically logs any such record
+// that's been outstanding longer than DebugWatchdogThreshold.
+//
+// Debug instrumentation adds overhead (principally, capturing a stack
+// trace on every successful Acquire, every Wait, and every write Lock), so
+// it should normally only be enabled for troubleshooting, e.g. from a
+// debug HTTP handler.
+func SetDebug(v bool) {
+	debugEnabled.Store(v)
+	if v {
+		debugWatchdogOnce.Do(func() { go debugWatchdog() })
+	}
+}
+
+// DebugWatchdogThreshold is how long a tracked acquisition must be
+// outstanding before the debug watchdog logs it. It is only consulted
+// while debug mode is enabled; see SetDebug.
+var DebugWatchdogThreshold = 30 * time.Second
+
+var debugWatchdogOnce sync.Once
+
+func debugWatchdog() {
+	for {
+		time.Sleep(5 * time.Second)
+		if !debugEnabled.Load() {
+			continue
+		}
+		now := time.Now()
+		debugMu.Lock()
+		for _, h := range debugHolds {
+			if d := now.Sub(h.since); d > DebugWatchdogThreshold {
+				log.Printf("syncs: %s has been held for %v, acquired at:\n%s", h.kind, d.Round(time.Second), h.stack)
+			}
+		}
+		debugMu.Unlock()
+	}
+}
+
+// debugHold records where and when a tracked Semaphore or WaitGroupChan
+// acquisition happened.
+type debugHold struct {
+	id    uint64
+	kind  string
+	stack []byte
+	since time.Time
+}
+
+var (
+	debugMu    sync.Mutex
+	debugHolds = map[uint64]*debugHold{}
+	debugNext  atomic.Uint64
+)
+
+// debugAcquire records, if debug mode is enabled, that the calling
+// goroutine just acquired the named resource, and returns a handle to
+// pass to debugRelease once it's given up. It returns nil if debug mode
+// is disabled.
+func debugAcquire(kind string) *debugHold {
+	if !debugEnabled.Load() {
+		return nil
+	}
+	h := &debugHold{id: debugNext.Add(1), kind: kind, stack: debugStack(), since: time.Now()}
+	debugMu.Lock()
+	debugHolds[h.id] = h
+	debugMu.Unlock()
+	return h
+}
+
+// debugRelease retires a hold previously returned by debugAcquire. It's a
+// no-op if h is nil (as it is when debug mode was disabled at acquire
+// time).
+func debugRelease(h *debugHold) {
+	if h == nil {
+		return
+	}
+	debugMu.Lock()
+	delete(debugHolds, h.id)
+	debugMu.Unlock()
+}
+
+func debugStack() []byte {
+	buf := make([]byte, 4096)
+	for {
+		n := runtime.Stack(buf, false)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// Dump writes a report of all currently outstanding debug-tracked
+// acquisitions (see SetDebug) to w, oldest first, including the stack
+// trace of where each was acquired. It's intended to be wired up to
+// tailscaled's debug handler.
+func Dump(w io.Writer) {
+	debugMu.Lock()
+	holds := make([]*debugHold, 0, len(debugHolds))
+	for _, h := range debugHolds {
+		holds = append(holds, h)
+	}
+	debugMu.Unlock()
+
+	sort.Slice(holds, func(i, j int) bool { return holds[i].since.Before(holds[j].since) })
+	now := time.Now()
+	for _, h := range holds {
+		fmt.Fprintf(w, "%s: held %v, acquired at:\n%s\n", h.kind, now.Sub(h.since).Round(time.Millisecond), h.stack)
+	}
+}
+
+// DebugMutex is like a [sync.Mutex], but tracks which goroutine currently
+// holds it, so that CheckLocked can be used to assert that invariant
+// requiring the lock be held. It's useful for cheaply documenting and
+// enforcing locking expectations in code that's hard to reason about
+// statically.
+//
+// The zero value is an unlocked mutex, ready to use.
+type DebugMutex struct {
+	mu     sync.Mutex
+	holder atomic.Int64 // goroutine id of current holder, or 0 if unlocked
+}
+
+// Lock locks m, blocking until it's available.
+func (m *DebugMutex) Lock() {
+	m.mu.Lock()
+	m.holder.Store(goroutineID())
+}
+
+// TryLock tries to lock m and reports whether it succeeded.
+func (m *DebugMutex) TryLock() bool {
+	if !m.mu.TryLock() {
+		return false
+	}
+	m.holder.Store(goroutineID())
+	return true
+}
+
+// Unlock unlocks m. As with [sync.Mutex], it is a run-time error if m is
+// not locked.
+func (m *DebugMutex) Unlock() {
+	m.holder.Store(0)
+	m.mu.Unlock()
+}
+
+// CheckLocked panics unless m is currently locked by the calling
+// goroutine.
+func (m *DebugMutex) CheckLocked() {
+	if got := m.holder.Load(); got != goroutineID() {
+		panic("syncs: DebugMutex.CheckLocked called without holding the lock")
+	}
+}
+
+// goroutineID returns the id of the calling goroutine, by parsing it out
+// of a runtime.Stack trace. It's relatively expensive and is only used by
+// the debug instrumentation above.
+func goroutineID() int64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	b := bytes.TrimPrefix(buf[:n], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseInt(string(b), 10, 64)
+	return id
+}
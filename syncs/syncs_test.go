@@ -0,0 +1,384 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package syncs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWeightedSemaphore(t *testing.T) {
+	s := NewWeightedSemaphore(2)
+	if err := s.Acquire(context.Background(), 2); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if s.TryAcquire(1) {
+		t.Fatal("TryAcquire succeeded over capacity")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Acquire(ctx, 1); err == nil {
+		t.Fatal("Acquire succeeded over capacity; want context deadline error")
+	}
+
+	s.Release(2)
+	if !s.TryAcquire(2) {
+		t.Fatal("TryAcquire failed after Release")
+	}
+}
+
+func TestWeightedSemaphoreFIFO(t *testing.T) {
+	s := NewWeightedSemaphore(1)
+	if err := s.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var order []int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Give goroutines time to enqueue in order.
+			time.Sleep(time.Duration(i) * 5 * time.Millisecond)
+			if err := s.Acquire(context.Background(), 1); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			s.Release(1)
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond) // let all three enqueue
+	s.Release(1)
+	wg.Wait()
+
+	for i, got := range order {
+		if got != i {
+			t.Errorf("waiter order = %v; want FIFO 0,1,2", order)
+			break
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	g, ctx := WithContext(context.Background())
+	errBoom := errors.New("boom")
+	g.Go(func() error { return nil })
+	g.Go(func() error { return errBoom })
+	if err := g.Wait(); err != errBoom {
+		t.Fatalf("Wait() = %v; want %v", err, errBoom)
+	}
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal("derived context not canceled after error")
+	}
+}
+
+// TestGroupHeterogeneousErrors verifies that two goroutines returning
+// errors of different concrete types don't trip a panic in the shared
+// error storage (previously implemented as an AtomicValue[error], whose
+// underlying atomic.Value panics on CompareAndSwap with inconsistent
+// concrete types).
+func TestGroupHeterogeneousErrors(t *testing.T) {
+	type errA struct{ error }
+	type errB struct{ error }
+	g, _ := WithContext(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	g.Go(func() error { defer wg.Done(); return errA{errors.New("a")} })
+	g.Go(func() error { defer wg.Done(); return errB{errors.New("b")} })
+	wg.Wait()
+	if err := g.Wait(); err == nil {
+		t.Fatal("Wait() = nil; want a non-nil error")
+	}
+}
+
+func TestGroupSetLimit(t *testing.T) {
+	g, _ := WithContext(context.Background())
+	g.SetLimit(2)
+	var cur, max atomic.Int64
+	for i := 0; i < 10; i++ {
+		g.Go(func() error {
+			n := cur.Add(1)
+			defer cur.Add(-1)
+			for {
+				old := max.Load()
+				if n <= old || max.CompareAndSwap(old, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if max.Load() > 2 {
+		t.Fatalf("observed %d concurrent goroutines; want <= 2", max.Load())
+	}
+}
+
+func TestSingleflightDo(t *testing.T) {
+	var g Singleflight[string, int]
+	v, err, shared := g.Do("k", func() (int, error) { return 42, nil })
+	if err != nil || v != 42 || shared {
+		t.Fatalf("Do() = %v, %v, %v; want 42, nil, false", v, err, shared)
+	}
+}
+
+// TestSingleflightDoRace stampedes Do with many concurrent callers for the
+// same key and verifies every caller observes the result computed by fn,
+// never the zero value. Run with -race to catch the data race this guards
+// against: a follower must not be able to read the shared result before
+// the leader's fn has actually finished.
+func TestSingleflightDoRace(t *testing.T) {
+	var g Singleflight[string, int]
+	var calls atomic.Int32
+	const n = 200
+	start := make(chan struct{})
+	results := make([]int, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			v, err, _ := g.Do("k", func() (int, error) {
+				calls.Add(1)
+				time.Sleep(time.Millisecond) // widen the stampede window
+				return 42, nil
+			})
+			results[i] = v
+			errs[i] = err
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatalf("caller %d: err = %v", i, errs[i])
+		}
+		if results[i] != 42 {
+			t.Fatalf("caller %d: v = %d; want 42", i, results[i])
+		}
+	}
+	if calls.Load() == 0 {
+		t.Fatal("fn was never called")
+	}
+}
+
+// TestSingleflightSharedLeader verifies that the original caller of a call
+// that turned out to have followers join it also gets shared=true, not
+// just the followers.
+func TestSingleflightSharedLeader(t *testing.T) {
+	var g Singleflight[string, int]
+	release := make(chan struct{})
+	joined := make(chan struct{})
+	var wg sync.WaitGroup
+
+	var leaderShared bool
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _, shared := g.Do("k", func() (int, error) {
+			close(joined)
+			<-release
+			return 42, nil
+		})
+		leaderShared = shared
+	}()
+
+	<-joined
+	var followerShared bool
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _, shared := g.Do("k", func() (int, error) { return 0, nil })
+		followerShared = shared
+	}()
+	time.Sleep(10 * time.Millisecond) // let the follower join before releasing
+	close(release)
+	wg.Wait()
+
+	if !leaderShared {
+		t.Error("leader's shared = false; want true since a follower joined it")
+	}
+	if !followerShared {
+		t.Error("follower's shared = false; want true")
+	}
+}
+
+// TestSingleflightPanic verifies that a panicking fn doesn't poison the
+// key: the entry must be removed so a later Do call for the same key
+// invokes fn again, rather than replaying a zero result forever.
+func TestSingleflightPanic(t *testing.T) {
+	var g Singleflight[string, int]
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Do did not propagate the panic from fn")
+			}
+		}()
+		g.Do("k", func() (int, error) { panic("boom") })
+	}()
+
+	var calls atomic.Int32
+	v, err, shared := g.Do("k", func() (int, error) {
+		calls.Add(1)
+		return 42, nil
+	})
+	if err != nil || v != 42 || shared {
+		t.Fatalf("Do() after panic = %v, %v, %v; want 42, nil, false", v, err, shared)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("fn called %d times after a panicking call; want 1 (key must not be poisoned)", calls.Load())
+	}
+}
+
+// TestSingleflightPanicWaiters verifies that a goroutine waiting on an
+// in-flight call whose fn panics also observes the panic, rather than a
+// zero result.
+func TestSingleflightPanicWaiters(t *testing.T) {
+	var g Singleflight[string, int]
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	panics := make([]bool, 2)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() { recover() }()
+		g.Do("k", func() (int, error) {
+			<-release
+			panic("boom")
+		})
+	}()
+	time.Sleep(10 * time.Millisecond) // let the leader install the call
+
+	for i := range panics {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() {
+				panics[i] = recover() != nil
+			}()
+			g.Do("k", func() (int, error) { return 0, nil })
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond) // let the followers join
+	close(release)
+	wg.Wait()
+
+	for i, p := range panics {
+		if !p {
+			t.Errorf("waiter %d did not observe the leader's panic", i)
+		}
+	}
+}
+
+func TestSingleflightForget(t *testing.T) {
+	var g Singleflight[string, int]
+	var calls atomic.Int32
+	fn := func() (int, error) {
+		calls.Add(1)
+		return int(calls.Load()), nil
+	}
+	v1, _, _ := g.Do("k", fn)
+	g.Forget("k")
+	v2, _, _ := g.Do("k", fn)
+	if v1 == v2 {
+		t.Fatalf("Forget did not cause fn to be recalled: both calls returned %d", v1)
+	}
+}
+
+func TestShardedMap(t *testing.T) {
+	m := NewShardedMap[string, int](NumShards[string](4))
+	m.Store("a", 1)
+	m.Store("b", 2)
+	if v, ok := m.Load("a"); !ok || v != 1 {
+		t.Fatalf("Load(a) = %v, %v; want 1, true", v, ok)
+	}
+	if v, loaded := m.LoadOrStore("a", 99); !loaded || v != 1 {
+		t.Fatalf("LoadOrStore(a) = %v, %v; want 1, true", v, loaded)
+	}
+	if v, loaded := m.LoadOrStore("c", 3); loaded || v != 3 {
+		t.Fatalf("LoadOrStore(c) = %v, %v; want 3, false", v, loaded)
+	}
+
+	got := map[string]int{}
+	m.Range(func(k string, v int) bool {
+		got[k] = v
+		return true
+	})
+	want := map[string]int{"a": 1, "b": 2, "c": 3}
+	if len(got) != len(want) {
+		t.Fatalf("Range saw %v; want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("Range saw %v; want %v", got, want)
+		}
+	}
+
+	if v, loaded := m.LoadAndDelete("a"); !loaded || v != 1 {
+		t.Fatalf("LoadAndDelete(a) = %v, %v; want 1, true", v, loaded)
+	}
+	if _, ok := m.Load("a"); ok {
+		t.Fatal("Load(a) found a value after LoadAndDelete")
+	}
+
+	m.Delete("b")
+	if _, ok := m.Load("b"); ok {
+		t.Fatal("Load(b) found a value after Delete")
+	}
+}
+
+func TestShardedMapCustomHasher(t *testing.T) {
+	m := NewShardedMap[int, string](NumShards[int](8), WithHasher(func(k int) uint64 { return uint64(k) }))
+	for i := 0; i < 100; i++ {
+		m.Store(i, "x")
+	}
+	n := 0
+	m.Range(func(int, string) bool { n++; return true })
+	if n != 100 {
+		t.Fatalf("Range saw %d entries; want 100", n)
+	}
+}
+
+func TestDebugMutex(t *testing.T) {
+	var m DebugMutex
+	m.Lock()
+	m.CheckLocked()
+	m.Unlock()
+
+	if !m.TryLock() {
+		t.Fatal("TryLock failed on unlocked mutex")
+	}
+	m.CheckLocked()
+	m.Unlock()
+}
+
+func TestDebugMutexCheckLockedPanics(t *testing.T) {
+	var m DebugMutex
+	defer func() {
+		if recover() == nil {
+			t.Fatal("CheckLocked on an unlocked mutex did not panic")
+		}
+	}()
+	m.CheckLocked()
+}